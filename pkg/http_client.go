@@ -1,23 +1,34 @@
 package pkg
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"net/http"
 	neturl "net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	HTTP_2xx = 2
 	HTTP_4xx = 4
+	HTTP_5xx = 5
 )
 
+// defaultMaxResponseBytes is the response size cap applied when
+// HttpClient.MaxResponseBytes is left unset.
+const defaultMaxResponseBytes int64 = 10 * 1024 * 1024
+
 type Err error
 
 type ErrTimeout struct{
@@ -26,12 +37,127 @@ type ErrTimeout struct{
 
 type ErrNotFound struct{
 	Err
+	// StatusCode is the HTTP status that produced this error, when known.
+	StatusCode int
 }
 
 type ErrInvalid struct{
 	Err
 }
 
+type ErrCanceled struct{
+	Err
+}
+
+type ErrTooLarge struct{
+	Err
+}
+
+// RetryPolicy decides whether a failed attempt should be retried and how
+// long to wait before the next one. It lets integrators with strict SLAs
+// (e.g. cloud metadata fetchers) swap in their own retry behavior instead
+// of being locked into HttpClient's defaults.
+type RetryPolicy interface {
+	// ShouldRetry is called after an attempt fails, either with a transport
+	// error (resp is nil) or with a non-2xx response (err is nil). attempt
+	// is 1-indexed and counts the attempt that just failed.
+	ShouldRetry(resp *http.Response, err error, attempt int) bool
+
+	// NextBackoff returns how long to sleep after the given (1-indexed)
+	// failed attempt, before the next one is made.
+	NextBackoff(attempt int) time.Duration
+}
+
+// DefaultRetryPolicy retries network errors, 408, 425, 429 and 5xx
+// responses, making at most MaxRetries attempts in total, using full-jitter
+// exponential backoff capped at MaxBackoff.
+type DefaultRetryPolicy struct {
+	MaxRetries int
+	MaxBackoff time.Duration
+}
+
+// NewDefaultRetryPolicy returns a DefaultRetryPolicy with the given limits.
+func NewDefaultRetryPolicy(maxRetries int, maxBackoff time.Duration) *DefaultRetryPolicy {
+	return &DefaultRetryPolicy{
+		MaxRetries: maxRetries,
+		MaxBackoff: maxBackoff,
+	}
+}
+
+func (p *DefaultRetryPolicy) ShouldRetry(resp *http.Response, err error, attempt int) bool {
+	if attempt >= p.MaxRetries {
+		return false
+	}
+
+	if err != nil {
+		return true
+	}
+
+	return isRetryableStatus(resp.StatusCode)
+}
+
+// isRetryableStatus reports whether code is one of the statuses this client
+// treats as transient (408, 425, 429, or any 5xx) rather than a terminal
+// client error.
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return true
+	}
+	return code/100 == HTTP_5xx
+}
+
+// NextBackoff implements full-jitter exponential backoff:
+// sleep = rand(0, min(MaxBackoff, base * 2^attempt))
+func (p *DefaultRetryPolicy) NextBackoff(attempt int) time.Duration {
+	max := p.MaxBackoff
+	if max <= 0 {
+		max = 5 * time.Second
+	}
+
+	base := 50 * time.Millisecond
+	backoff := max
+	if attempt < 63 { // avoid overflowing the shift
+		if shifted := base * time.Duration(uint64(1)<<uint(attempt)); shifted > 0 && shifted < max {
+			backoff = shifted
+		}
+	}
+
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+// retryAfter returns the delay requested by a 429/503 response's
+// Retry-After header, either as a number of seconds or an HTTP-date.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return 0, false
+	}
+
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+
+	if when, err := http.ParseTime(value); err == nil {
+		if wait := time.Until(when); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
 type HttpClient struct {
 	// Maximum exp backoff duration. Defaults to 5 seconds
 	MaxBackoff time.Duration
@@ -45,27 +171,241 @@ type HttpClient struct {
 
 	// Whether or not to skip TLS verification. Defaults to false
 	SkipTLS bool
+
+	// Deadline bounds the total wall-clock time spent on a single Get call,
+	// across all attempts and sleeps: no attempt starts and no backoff sleep
+	// runs past it. An attempt already in progress when it passes is not cut
+	// short. Zero means no overall deadline is enforced and only
+	// MaxRetries/RetryPolicy bound the loop.
+	Deadline time.Duration
+
+	// RetryPolicy controls which failures are retried and how long to wait
+	// in between. Defaults to NewDefaultRetryPolicy(MaxRetries, MaxBackoff)
+	// when left nil.
+	RetryPolicy RetryPolicy
+
+	// CACertFile is a path to a PEM-encoded CA certificate bundle used to
+	// verify the server's certificate, for metadata endpoints signed by a
+	// private CA. Ignored if TLSConfig is set.
+	CACertFile string
+
+	// CACertPEM is a PEM-encoded CA certificate bundle, for callers that
+	// already have the bundle in memory instead of on disk. CACertFile
+	// takes precedence if both are set.
+	CACertPEM []byte
+
+	// ClientCertFile and ClientKeyFile are paths to a PEM-encoded client
+	// certificate and key presented for mutual TLS authentication against
+	// mTLS-protected metadata services. Both must be set together.
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// TLSConfig, when set, is used verbatim instead of the config built
+	// from the fields above. It's an escape hatch for TLS requirements this
+	// client doesn't otherwise expose.
+	TLSConfig *tls.Config
+
+	// CredentialProvider, when set, is asked for a header/value pair before
+	// every attempt so short-lived credentials (bearer tokens, signed
+	// headers) can be attached, and refreshed transparently between
+	// retries.
+	CredentialProvider CredentialProvider
+
+	// MaxResponseBytes caps how much of a response Get will buffer into
+	// memory, returning ErrTooLarge if exceeded. Defaults to 10 MiB. Does
+	// not apply to GetStream, which hands the caller the raw body instead
+	// of buffering it.
+	MaxResponseBytes int64
+
+	tlsConfigOnce sync.Once
+	tlsConfig     *tls.Config
+	tlsConfigErr  error
+}
+
+// CredentialProvider supplies the header/value pair attached to every
+// outgoing request, e.g. "Authorization"/"Bearer <token>". It's invoked
+// before each attempt, not just once per Get call, so providers backed by
+// short-lived or rotating credentials can refresh between retries.
+type CredentialProvider interface {
+	Token(ctx context.Context) (header string, value string, err error)
+}
+
+// StaticBearerTokenProvider attaches a fixed bearer token to every request.
+type StaticBearerTokenProvider struct {
+	token string
+}
+
+// NewStaticBearerTokenProvider returns a CredentialProvider that always
+// attaches the given bearer token.
+func NewStaticBearerTokenProvider(token string) *StaticBearerTokenProvider {
+	return &StaticBearerTokenProvider{token: token}
+}
+
+func (p *StaticBearerTokenProvider) Token(ctx context.Context) (string, string, error) {
+	return "Authorization", "Bearer " + p.token, nil
+}
+
+// FileTokenProvider re-reads a bearer token from disk on every call,
+// mirroring how STS/workload-identity subject tokens are rotated on the
+// filesystem by the platform instead of refreshed in-process.
+type FileTokenProvider struct {
+	// Path is the file holding the current token.
+	Path string
+
+	// Header is the HTTP header to set the token on. Defaults to
+	// "Authorization" when empty.
+	Header string
+}
+
+// NewFileTokenProvider returns a CredentialProvider that re-reads the
+// bearer token from path on every call.
+func NewFileTokenProvider(path string) *FileTokenProvider {
+	return &FileTokenProvider{Path: path, Header: "Authorization"}
+}
+
+func (p *FileTokenProvider) Token(ctx context.Context) (string, string, error) {
+	data, err := ioutil.ReadFile(p.Path)
+	if err != nil {
+		return "", "", ErrInvalid{fmt.Errorf("Unable to read token file %s: %s", p.Path, err)}
+	}
+
+	header := p.Header
+	if header == "" {
+		header = "Authorization"
+	}
+
+	return header, "Bearer " + strings.TrimSpace(string(data)), nil
 }
 
 func NewHttpClient() *HttpClient {
 	return &HttpClient{
-		MaxBackoff: time.Second * 5,
-		MaxRetries: 15,
-		Timeout:    time.Duration(2) * time.Second,
-		SkipTLS:    false,
+		MaxBackoff:       time.Second * 5,
+		MaxRetries:       15,
+		Timeout:          time.Duration(2) * time.Second,
+		SkipTLS:          false,
+		MaxResponseBytes: defaultMaxResponseBytes,
 	}
 }
 
-func expBackoff(interval, max time.Duration) time.Duration {
-	interval = interval * 2
-	if interval > max {
-		interval = max
+func (h *HttpClient) retryPolicy() RetryPolicy {
+	if h.RetryPolicy != nil {
+		return h.RetryPolicy
 	}
-	return interval
+	return NewDefaultRetryPolicy(h.MaxRetries, h.MaxBackoff)
+}
+
+func (h *HttpClient) maxResponseBytes() int64 {
+	if h.MaxResponseBytes > 0 {
+		return h.MaxResponseBytes
+	}
+	return defaultMaxResponseBytes
+}
+
+// buildTLSConfig builds and caches the *tls.Config used for every request,
+// so cert pools are only parsed once per HttpClient rather than on every
+// attempt.
+func (h *HttpClient) buildTLSConfig() (*tls.Config, error) {
+	h.tlsConfigOnce.Do(func() {
+		if h.TLSConfig != nil {
+			h.tlsConfig = h.TLSConfig
+			return
+		}
+
+		cfg := &tls.Config{
+			InsecureSkipVerify: h.SkipTLS,
+		}
+
+		if h.CACertFile != "" || len(h.CACertPEM) > 0 {
+			pem := h.CACertPEM
+			if h.CACertFile != "" {
+				data, err := ioutil.ReadFile(h.CACertFile)
+				if err != nil {
+					h.tlsConfigErr = ErrInvalid{fmt.Errorf("Unable to read CA cert file %s: %s", h.CACertFile, err)}
+					return
+				}
+				pem = data
+			}
+
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				h.tlsConfigErr = ErrInvalid{errors.New("No valid certificates found in CA bundle")}
+				return
+			}
+			cfg.RootCAs = pool
+		}
+
+		if h.ClientCertFile != "" || h.ClientKeyFile != "" {
+			cert, err := tls.LoadX509KeyPair(h.ClientCertFile, h.ClientKeyFile)
+			if err != nil {
+				h.tlsConfigErr = ErrInvalid{fmt.Errorf("Unable to load client certificate/key: %s", err)}
+				return
+			}
+			cfg.Certificates = []tls.Certificate{cert}
+		}
+
+		h.tlsConfig = cfg
+	})
+
+	return h.tlsConfig, h.tlsConfigErr
 }
 
 // Fetches a given URL with support for exponential backoff and maximum retries
 func (h *HttpClient) Get(rawurl string) ([]byte, error) {
+	return h.GetWithContext(context.Background(), rawurl)
+}
+
+// GetWithContext behaves like Get but aborts retries and sleeps as soon as
+// ctx is done, returning ctx.Err() wrapped as ErrTimeout or ErrCanceled
+// instead of waiting for the remaining attempts or backoff to play out. The
+// response body is buffered up to MaxResponseBytes, returning ErrTooLarge
+// if exceeded; use GetStream to decode large bodies incrementally instead.
+func (h *HttpClient) GetWithContext(ctx context.Context, rawurl string) ([]byte, error) {
+	resp, err := h.doGet(ctx, rawurl)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return readLimited(resp.Body, h.maxResponseBytes())
+}
+
+// GetStream fetches rawurl like Get, but returns the (retry-wrapped)
+// response body directly instead of buffering it, so large or streamed
+// payloads can be decoded incrementally. MaxResponseBytes is not enforced;
+// callers are responsible for bounding their own reads. The caller must
+// close the returned ReadCloser.
+func (h *HttpClient) GetStream(rawurl string) (io.ReadCloser, error) {
+	return h.GetStreamWithContext(context.Background(), rawurl)
+}
+
+// GetStreamWithContext behaves like GetStream but threads ctx through the
+// retry loop, the same way GetWithContext does for Get.
+func (h *HttpClient) GetStreamWithContext(ctx context.Context, rawurl string) (io.ReadCloser, error) {
+	resp, err := h.doGet(ctx, rawurl)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// readLimited reads body up to max bytes, returning ErrTooLarge if the body
+// doesn't fit.
+func readLimited(body io.Reader, max int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(body, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, ErrTooLarge{fmt.Errorf("Response exceeds maximum of %d bytes", max)}
+	}
+	return data, nil
+}
+
+// doGet runs the retry loop and returns the successful 2xx response for the
+// caller to read and close. Non-2xx and transport-error handling, retries,
+// backoff and cancellation all happen here; Get and GetStream only differ
+// in how they consume the returned body.
+func (h *HttpClient) doGet(ctx context.Context, rawurl string) (*http.Response, error) {
 	if rawurl == "" {
 		return nil, ErrInvalid{errors.New("URL is empty. Skipping.")}
 	}
@@ -83,13 +423,16 @@ func (h *HttpClient) Get(rawurl string) ([]byte, error) {
 
 	dataURL := url.String()
 
+	tlsConfig, err := h.buildTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
 	// We need to create our own client in order to add timeout support.
 	// TODO(c4milo) Replace it once Go 1.3 is officially used by CoreOS
 	// More info: https://code.google.com/p/go/source/detail?r=ada6f2d5f99f
 	transport := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: h.SkipTLS,
-		},
+		TLSClientConfig: tlsConfig,
 		Dial: func(network, addr string) (net.Conn, error) {
 			deadline := time.Now().Add(h.Timeout)
 			c, err := net.DialTimeout(network, addr, h.Timeout)
@@ -105,33 +448,119 @@ func (h *HttpClient) Get(rawurl string) ([]byte, error) {
 		Transport: transport,
 	}
 
-	duration := 50 * time.Millisecond
-	for retry := 1; retry <= h.MaxRetries; retry++ {
-		log.Printf("Fetching data from %s. Attempt #%d", dataURL, retry)
+	policy := h.retryPolicy()
+
+	var deadline time.Time
+	if h.Deadline > 0 {
+		deadline = time.Now().Add(h.Deadline)
+	}
+
+	// capSleep shortens a backoff sleep so it never runs past the deadline.
+	capSleep := func(d time.Duration) time.Duration {
+		if !deadline.IsZero() {
+			if remaining := time.Until(deadline); d > remaining {
+				return remaining
+			}
+		}
+		return d
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, wrapCtxErr(err)
+		}
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return nil, ErrTimeout{fmt.Errorf("Unable to fetch data. Deadline of %v reached.", h.Deadline)}
+		}
+
+		log.Printf("Fetching data from %s. Attempt #%d", dataURL, attempt)
+
+		req, err := http.NewRequestWithContext(ctx, "GET", dataURL, nil)
+		if err != nil {
+			return nil, ErrInvalid{err}
+		}
+
+		if h.CredentialProvider != nil {
+			header, value, err := h.CredentialProvider.Token(ctx)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set(header, value)
+		}
 
-		resp, err := client.Get(dataURL)
+		resp, err := client.Do(req)
 
 		if err == nil {
-			defer resp.Body.Close()
 			status := resp.StatusCode / 100
 
 			if status == HTTP_2xx {
-				return ioutil.ReadAll(resp.Body)
+				return resp, nil
 			}
 
-			if status == HTTP_4xx {
-				return nil, ErrNotFound{fmt.Errorf("Not found. HTTP status code: %d", resp.StatusCode)}
+			if !policy.ShouldRetry(resp, nil, attempt) {
+				resp.Body.Close()
+				// A retryable-class status (408/425/429/5xx) that's still
+				// failing once retries are exhausted is a timeout, not a
+				// terminal client error - only a genuinely non-retryable
+				// 4xx (e.g. 404) is ErrNotFound.
+				if status == HTTP_4xx && !isRetryableStatus(resp.StatusCode) {
+					return nil, ErrNotFound{fmt.Errorf("Not found. HTTP status code: %d", resp.StatusCode), resp.StatusCode}
+				}
+				return nil, ErrTimeout{fmt.Errorf("Unable to fetch data. HTTP status code: %d", resp.StatusCode)}
 			}
 
 			log.Printf("Server error. HTTP status code: %d", resp.StatusCode)
-		} else {
-			log.Printf("Unable to fetch data: %s", err.Error())
+
+			duration, ok := retryAfter(resp)
+			if !ok {
+				duration = policy.NextBackoff(attempt)
+			}
+			duration = capSleep(duration)
+			resp.Body.Close()
+			log.Printf("Sleeping for %v...", duration)
+			if err := sleepCtx(ctx, duration); err != nil {
+				return nil, wrapCtxErr(err)
+			}
+			continue
 		}
 
-		duration = expBackoff(duration, h.MaxBackoff)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, wrapCtxErr(ctxErr)
+		}
+
+		log.Printf("Unable to fetch data: %s", err.Error())
+
+		if !policy.ShouldRetry(nil, err, attempt) {
+			return nil, ErrTimeout{fmt.Errorf("Unable to fetch data: %s", err.Error())}
+		}
+
+		duration := capSleep(policy.NextBackoff(attempt))
 		log.Printf("Sleeping for %v...", duration)
-		time.Sleep(duration)
+		if err := sleepCtx(ctx, duration); err != nil {
+			return nil, wrapCtxErr(err)
+		}
 	}
+}
+
+// sleepCtx sleeps for d, returning early with ctx.Err() if ctx is done first.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
 
-	return nil, ErrTimeout{fmt.Errorf("Unable to fetch data. Maximum retries reached: %d", h.MaxRetries)}
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wrapCtxErr turns a context error into the ErrTimeout/ErrCanceled the rest
+// of HttpClient's callers already know how to handle.
+func wrapCtxErr(err error) error {
+	if errors.Is(err, context.Canceled) {
+		return ErrCanceled{err}
+	}
+	return ErrTimeout{err}
 }
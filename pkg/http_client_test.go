@@ -0,0 +1,425 @@
+package pkg
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIsRetryableStatus(t *testing.T) {
+	cases := []struct {
+		code int
+		want bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusNotFound, false},
+		{http.StatusUnauthorized, false},
+		{http.StatusForbidden, false},
+		{http.StatusRequestTimeout, true},
+		{http.StatusTooEarly, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusBadGateway, true},
+		{http.StatusServiceUnavailable, true},
+	}
+
+	for _, c := range cases {
+		if got := isRetryableStatus(c.code); got != c.want {
+			t.Errorf("isRetryableStatus(%d) = %v, want %v", c.code, got, c.want)
+		}
+	}
+}
+
+func TestDefaultRetryPolicyShouldRetry(t *testing.T) {
+	policy := NewDefaultRetryPolicy(3, time.Second)
+
+	tooManyRequests := &http.Response{StatusCode: http.StatusTooManyRequests}
+	notFound := &http.Response{StatusCode: http.StatusNotFound}
+
+	if !policy.ShouldRetry(tooManyRequests, nil, 1) {
+		t.Error("expected 429 to be retryable before MaxRetries is reached")
+	}
+	if policy.ShouldRetry(tooManyRequests, nil, 3) {
+		t.Error("expected 429 to stop retrying once attempt reaches MaxRetries")
+	}
+	if policy.ShouldRetry(notFound, nil, 1) {
+		t.Error("expected 404 to never be retryable, regardless of attempt")
+	}
+	if !policy.ShouldRetry(nil, errors.New("connection refused"), 1) {
+		t.Error("expected network errors to be retryable before MaxRetries is reached")
+	}
+	if policy.ShouldRetry(nil, errors.New("connection refused"), 3) {
+		t.Error("expected network errors to stop retrying once attempt reaches MaxRetries")
+	}
+}
+
+// TestGetExhaustedRetryableStatusIsTimeout guards against a 429/425/408
+// that never recovers being misreported as ErrNotFound once retries are
+// exhausted - it's a timeout, not a terminal client error.
+func TestGetExhaustedRetryableStatusIsTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	client := NewHttpClient()
+	client.MaxRetries = 2
+	client.MaxBackoff = time.Millisecond
+
+	_, err := client.Get(srv.URL)
+	if _, ok := err.(ErrTimeout); !ok {
+		t.Fatalf("expected ErrTimeout, got %T: %v", err, err)
+	}
+}
+
+// TestGetTerminal4xxIsNotFound guards the other side of the same branch: a
+// genuinely non-retryable 4xx must still be ErrNotFound.
+func TestGetTerminal4xxIsNotFound(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	client := NewHttpClient()
+	client.MaxRetries = 2
+	client.MaxBackoff = time.Millisecond
+
+	_, err := client.Get(srv.URL)
+	nf, ok := err.(ErrNotFound)
+	if !ok {
+		t.Fatalf("expected ErrNotFound, got %T: %v", err, err)
+	}
+	if nf.StatusCode != http.StatusNotFound {
+		t.Errorf("expected StatusCode %d, got %d", http.StatusNotFound, nf.StatusCode)
+	}
+}
+
+// TestGetWithContextCancelMidRequest guards cancellation while an attempt's
+// request is in flight: the server stalls, ctx is canceled mid-request, and
+// GetWithContext must return ErrCanceled rather than waiting it out or
+// retrying.
+func TestGetWithContextCancelMidRequest(t *testing.T) {
+	started := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(time.Second)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	client := NewHttpClient()
+	client.MaxRetries = 5
+	client.Timeout = 5 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	_, err := client.GetWithContext(ctx, srv.URL)
+	if _, ok := err.(ErrCanceled); !ok {
+		t.Fatalf("expected ErrCanceled, got %T: %v", err, err)
+	}
+}
+
+// TestGetWithContextCancelDuringBackoff guards cancellation while sleeping
+// between retries: the server always 503s with a 2 second Retry-After, ctx
+// is canceled shortly after the first attempt, and GetWithContext must
+// return promptly with ErrCanceled instead of sleeping out the full backoff.
+func TestGetWithContextCancelDuringBackoff(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "2")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	client := NewHttpClient()
+	client.MaxRetries = 1000
+	client.MaxBackoff = 2 * time.Second
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := client.GetWithContext(ctx, srv.URL)
+	elapsed := time.Since(start)
+
+	if _, ok := err.(ErrCanceled); !ok {
+		t.Fatalf("expected ErrCanceled, got %T: %v", err, err)
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Fatalf("expected sleepCtx to abort promptly on cancellation, took %v", elapsed)
+	}
+}
+
+// TestGetDeadlineExceeded guards HttpClient.Deadline: an endpoint that never
+// recovers must be cut off once the overall deadline elapses, reported as
+// ErrTimeout, rather than continuing to retry up to MaxRetries.
+func TestGetDeadlineExceeded(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	client := NewHttpClient()
+	client.MaxRetries = 1000
+	client.MaxBackoff = time.Millisecond
+	client.Deadline = 50 * time.Millisecond
+
+	_, err := client.Get(srv.URL)
+	if _, ok := err.(ErrTimeout); !ok {
+		t.Fatalf("expected ErrTimeout from Deadline expiry, got %T: %v", err, err)
+	}
+}
+
+// TestGetWithCACertPEM is the happy path: a CA bundle trusting the test
+// server's own certificate lets Get succeed without SkipTLS.
+func TestGetWithCACertPEM(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	client := NewHttpClient()
+	client.CACertPEM = certPEM
+
+	data, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(data) != "ok" {
+		t.Fatalf("unexpected body: %q", data)
+	}
+}
+
+// TestBuildTLSConfigMalformedCACertPEM guards the "surface clear ErrInvalid
+// errors for malformed PEM files" contract for CACertPEM.
+func TestBuildTLSConfigMalformedCACertPEM(t *testing.T) {
+	client := NewHttpClient()
+	client.CACertPEM = []byte("not a pem certificate")
+
+	_, err := client.Get("https://example.invalid")
+	if _, ok := err.(ErrInvalid); !ok {
+		t.Fatalf("expected ErrInvalid, got %T: %v", err, err)
+	}
+}
+
+// TestBuildTLSConfigMissingCACertFile covers the same contract for a
+// CACertFile that can't be read.
+func TestBuildTLSConfigMissingCACertFile(t *testing.T) {
+	client := NewHttpClient()
+	client.CACertFile = filepath.Join(t.TempDir(), "does-not-exist.pem")
+
+	_, err := client.Get("https://example.invalid")
+	if _, ok := err.(ErrInvalid); !ok {
+		t.Fatalf("expected ErrInvalid, got %T: %v", err, err)
+	}
+}
+
+// TestBuildTLSConfigInvalidClientCert covers a mismatched/unparsable
+// ClientCertFile+ClientKeyFile pair.
+func TestBuildTLSConfigInvalidClientCert(t *testing.T) {
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+
+	if err := ioutil.WriteFile(certPath, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewHttpClient()
+	client.ClientCertFile = certPath
+	client.ClientKeyFile = keyPath
+
+	_, err := client.Get("https://example.invalid")
+	if _, ok := err.(ErrInvalid); !ok {
+		t.Fatalf("expected ErrInvalid, got %T: %v", err, err)
+	}
+}
+
+// TestStaticBearerTokenProviderAttachesHeader guards that CredentialProvider
+// actually attaches the header doGet is supposed to set per attempt.
+func TestStaticBearerTokenProviderAttachesHeader(t *testing.T) {
+	var gotHeader string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHeader = r.Header.Get("Authorization")
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	client := NewHttpClient()
+	client.CredentialProvider = NewStaticBearerTokenProvider("secret-token")
+
+	if _, err := client.Get(srv.URL); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gotHeader != "Bearer secret-token" {
+		t.Fatalf("expected Authorization header %q, got %q", "Bearer secret-token", gotHeader)
+	}
+}
+
+// TestCredentialProviderAttachedPerAttempt guards that the provider is
+// consulted on every retry, not just the first attempt.
+func TestCredentialProviderAttachedPerAttempt(t *testing.T) {
+	var headers []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header.Get("Authorization"))
+		if len(headers) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	client := NewHttpClient()
+	client.MaxRetries = 5
+	client.MaxBackoff = time.Millisecond
+	client.CredentialProvider = NewStaticBearerTokenProvider("secret-token")
+
+	if _, err := client.Get(srv.URL); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(headers) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(headers))
+	}
+	for i, h := range headers {
+		if h != "Bearer secret-token" {
+			t.Errorf("attempt %d: expected Authorization header, got %q", i+1, h)
+		}
+	}
+}
+
+// TestFileTokenProviderRereadsOnEachCall guards that a token rotated on
+// disk between retries is picked up on the next call, not cached forever.
+func TestFileTokenProviderRereadsOnEachCall(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(path, []byte("token-1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := NewFileTokenProvider(path)
+
+	_, value, err := provider.Token(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value != "Bearer token-1" {
+		t.Fatalf("expected %q, got %q", "Bearer token-1", value)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("token-2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, value, err = provider.Token(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if value != "Bearer token-2" {
+		t.Fatalf("expected token rotated on disk to be picked up, got %q", value)
+	}
+}
+
+// TestFileTokenProviderMissingFile guards the ErrInvalid contract when the
+// token file doesn't exist.
+func TestFileTokenProviderMissingFile(t *testing.T) {
+	provider := NewFileTokenProvider(filepath.Join(t.TempDir(), "does-not-exist"))
+
+	_, _, err := provider.Token(context.Background())
+	if _, ok := err.(ErrInvalid); !ok {
+		t.Fatalf("expected ErrInvalid, got %T: %v", err, err)
+	}
+}
+
+// TestGetEnforcesMaxResponseBytes guards the OOM-prevention contract: a body
+// over the cap must fail with ErrTooLarge rather than being buffered in
+// full.
+func TestGetEnforcesMaxResponseBytes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 100))
+	}))
+	defer srv.Close()
+
+	client := NewHttpClient()
+	client.MaxResponseBytes = 10
+
+	_, err := client.Get(srv.URL)
+	if _, ok := err.(ErrTooLarge); !ok {
+		t.Fatalf("expected ErrTooLarge, got %T: %v", err, err)
+	}
+}
+
+// TestGetUnderCapRoundTrips guards against an off-by-one in readLimited: a
+// body exactly at the cap must still round-trip correctly.
+func TestGetUnderCapRoundTrips(t *testing.T) {
+	const body = "hello world"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	client := NewHttpClient()
+	client.MaxResponseBytes = int64(len(body))
+
+	data, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(data) != body {
+		t.Fatalf("expected %q, got %q", body, data)
+	}
+}
+
+// TestGetStreamReturnsReadableRetryWrappedBody guards GetStream's two
+// promises: the retry loop still runs (a 503 is retried instead of handed
+// to the caller), and the body it finally returns is readable end to end.
+func TestGetStreamReturnsReadableRetryWrappedBody(t *testing.T) {
+	const body = "streamed payload"
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	client := NewHttpClient()
+	client.MaxRetries = 5
+	client.MaxBackoff = time.Millisecond
+
+	rc, err := client.GetStream(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+	if string(data) != body {
+		t.Fatalf("expected %q, got %q", body, data)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected GetStream to retry through the 503, got %d attempts", attempts)
+	}
+}
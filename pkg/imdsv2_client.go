@@ -0,0 +1,164 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	imdsTokenPath      = "/latest/api/token"
+	imdsTokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+	imdsTokenHeader    = "X-aws-ec2-metadata-token"
+
+	defaultIMDSEndpoint = "http://169.254.169.254"
+	defaultIMDSTokenTTL = 6 * time.Hour
+)
+
+// IMDSv2Client wraps an HttpClient with the IMDSv2 session-token handshake
+// required by EC2 instances that disable the older, tokenless IMDSv1 mode.
+// Before the first GET it exchanges a PUT /latest/api/token request for a
+// short-lived session token, caches it for its TTL, and attaches it to
+// subsequent GETs via the wrapped HttpClient's CredentialProvider hook.
+type IMDSv2Client struct {
+	// Client performs the actual metadata GETs, including retries, backoff
+	// and TLS. NewIMDSv2Client sets its CredentialProvider once, to attach
+	// the session token on every attempt; it must not be reassigned after
+	// construction.
+	Client *HttpClient
+
+	// MetadataEndpoint is the base URL of the instance metadata service.
+	// Defaults to the standard EC2 link-local address.
+	MetadataEndpoint string
+
+	// TokenTTL is the lifetime requested for each session token. Defaults
+	// to 6 hours.
+	TokenTTL time.Duration
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// NewIMDSv2Client returns an IMDSv2Client wrapping client. If client is nil,
+// a default HttpClient is created. client.CredentialProvider is set to pull
+// the session token from this IMDSv2Client and must not be changed
+// afterwards.
+func NewIMDSv2Client(client *HttpClient) *IMDSv2Client {
+	if client == nil {
+		client = NewHttpClient()
+	}
+
+	c := &IMDSv2Client{
+		Client:           client,
+		MetadataEndpoint: defaultIMDSEndpoint,
+		TokenTTL:         defaultIMDSTokenTTL,
+	}
+	c.Client.CredentialProvider = imdsTokenProvider{client: c}
+
+	return c
+}
+
+// Get fetches rawurl, handshaking for a session token first if needed.
+func (c *IMDSv2Client) Get(rawurl string) ([]byte, error) {
+	return c.GetWithContext(context.Background(), rawurl)
+}
+
+// GetWithContext behaves like Get but threads ctx through the handshake and
+// the underlying HttpClient, so both honor cancellation.
+func (c *IMDSv2Client) GetWithContext(ctx context.Context, rawurl string) ([]byte, error) {
+	data, err := c.Client.GetWithContext(ctx, rawurl)
+	if !isUnauthorized(err) {
+		return data, err
+	}
+
+	// The cached token may have been revoked or expired early; re-handshake
+	// and retry exactly once.
+	if _, err := c.sessionToken(ctx, true); err != nil {
+		return nil, err
+	}
+
+	return c.Client.GetWithContext(ctx, rawurl)
+}
+
+// imdsTokenProvider is the CredentialProvider wired onto Client at
+// construction. It pulls the current (possibly freshly-handshaken) session
+// token from client on every attempt, rather than having IMDSv2Client write
+// the token into Client's fields per call - Client.CredentialProvider is
+// set exactly once, so there's nothing to race on.
+type imdsTokenProvider struct {
+	client *IMDSv2Client
+}
+
+func (p imdsTokenProvider) Token(ctx context.Context) (string, string, error) {
+	token, err := p.client.sessionToken(ctx, false)
+	if err != nil {
+		return "", "", err
+	}
+	return imdsTokenHeader, token, nil
+}
+
+// sessionToken returns the cached session token, handshaking for a new one
+// if there isn't one yet, it has expired, or forceRefresh is set.
+func (c *IMDSv2Client) sessionToken(ctx context.Context, forceRefresh bool) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !forceRefresh && c.token != "" && time.Now().Before(c.tokenExpiry) {
+		return c.token, nil
+	}
+
+	ttl := c.TokenTTL
+	if ttl <= 0 {
+		ttl = defaultIMDSTokenTTL
+	}
+
+	endpoint := c.MetadataEndpoint
+	if endpoint == "" {
+		endpoint = defaultIMDSEndpoint
+	}
+	tokenURL := strings.TrimRight(endpoint, "/") + imdsTokenPath
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", tokenURL, nil)
+	if err != nil {
+		return "", ErrInvalid{err}
+	}
+	req.Header.Set(imdsTokenTTLHeader, strconv.Itoa(int(ttl.Seconds())))
+
+	client := &http.Client{Timeout: c.Client.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", ErrTimeout{fmt.Errorf("Unable to fetch IMDSv2 session token: %s", err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != HTTP_2xx {
+		return "", ErrNotFound{fmt.Errorf("Unable to fetch IMDSv2 session token. HTTP status code: %d", resp.StatusCode), resp.StatusCode}
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", ErrTimeout{err}
+	}
+
+	c.token = string(body)
+	c.tokenExpiry = time.Now().Add(ttl)
+
+	return c.token, nil
+}
+
+// isUnauthorized reports whether err is the ErrNotFound HttpClient returns
+// for a 401 or 403 response.
+func isUnauthorized(err error) bool {
+	var nf ErrNotFound
+	if !errors.As(err, &nf) {
+		return false
+	}
+	return nf.StatusCode == http.StatusUnauthorized || nf.StatusCode == http.StatusForbidden
+}
@@ -0,0 +1,78 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestIMDSv2ClientRehandshakesOnceOn401 verifies that a session token
+// rejected by the metadata endpoint triggers exactly one re-handshake and
+// retry, rather than failing outright or looping indefinitely.
+func TestIMDSv2ClientRehandshakesOnceOn401(t *testing.T) {
+	tokenRequests := 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "PUT" && r.URL.Path == imdsTokenPath:
+			tokenRequests++
+			fmt.Fprintf(w, "token-%d", tokenRequests)
+		case r.URL.Path == "/latest/meta-data/instance-id":
+			// Only the second issued token is considered valid, simulating
+			// a token that's rejected after being handed out once.
+			if r.Header.Get(imdsTokenHeader) != "token-2" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprint(w, "i-1234567890")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	httpClient := NewHttpClient()
+	httpClient.MaxRetries = 1
+	httpClient.MaxBackoff = time.Millisecond
+
+	imds := NewIMDSv2Client(httpClient)
+	imds.MetadataEndpoint = srv.URL
+
+	data, err := imds.Get(srv.URL + "/latest/meta-data/instance-id")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(data) != "i-1234567890" {
+		t.Fatalf("unexpected body: %q", data)
+	}
+	if tokenRequests != 2 {
+		t.Fatalf("expected exactly one re-handshake (2 token requests total), got %d", tokenRequests)
+	}
+}
+
+// TestIMDSv2ClientDoesNotMutateSharedCredentialProvider guards against
+// IMDSv2Client clobbering Client.CredentialProvider on every call -
+// NewIMDSv2Client should wire it up exactly once.
+func TestIMDSv2ClientDoesNotMutateSharedCredentialProvider(t *testing.T) {
+	httpClient := NewHttpClient()
+	imds := NewIMDSv2Client(httpClient)
+	// An address nothing listens on, so the handshake fails fast instead of
+	// depending on real network access to the link-local metadata address.
+	imds.MetadataEndpoint = "http://127.0.0.1:1"
+
+	provider := httpClient.CredentialProvider
+	if provider == nil {
+		t.Fatal("expected NewIMDSv2Client to set a CredentialProvider")
+	}
+
+	if _, err := imds.GetWithContext(context.Background(), "http://127.0.0.1:1/latest/meta-data/instance-id"); err == nil {
+		t.Fatal("expected an error fetching a token with no server running")
+	}
+
+	if httpClient.CredentialProvider != provider {
+		t.Error("CredentialProvider was reassigned instead of staying fixed after construction")
+	}
+}